@@ -0,0 +1,177 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"io"
+	"sync"
+)
+
+// An in-memory stand-in for FileLeaser, handing out fakeReadWriteLeases
+// instead of real temp-file-backed ones so tests don't touch disk.
+type fakeFileLeaser struct {
+	mu       sync.Mutex
+	newFiles int
+}
+
+func (fl *fakeFileLeaser) NewFile() (ReadWriteLease, error) {
+	fl.mu.Lock()
+	fl.newFiles++
+	fl.mu.Unlock()
+
+	return &fakeReadWriteLease{}, nil
+}
+
+func (fl *fakeFileLeaser) NewFileCount() int {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	return fl.newFiles
+}
+
+// An in-memory stand-in for a read/write lease, as handed out by
+// fakeFileLeaser.
+type fakeReadWriteLease struct {
+	data []byte
+	pos  int64
+}
+
+func (f *fakeReadWriteLease) Write(p []byte) (int, error) {
+	f.data = append(f.data, p...)
+	return len(p), nil
+}
+
+func (f *fakeReadWriteLease) Read(p []byte) (int, error) {
+	n, err := f.readAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *fakeReadWriteLease) ReadAt(p []byte, off int64) (int, error) {
+	return f.readAt(p, off)
+}
+
+func (f *fakeReadWriteLease) readAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (f *fakeReadWriteLease) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		f.pos = offset
+	case io.SeekCurrent:
+		f.pos += offset
+	case io.SeekEnd:
+		f.pos = int64(len(f.data)) + offset
+	}
+
+	return f.pos, nil
+}
+
+func (f *fakeReadWriteLease) Downgrade() (ReadLease, error) {
+	return &fakeReadLease{data: f.data}, nil
+}
+
+// An in-memory stand-in for a read lease, as handed out by
+// fakeReadWriteLease.Downgrade.
+type fakeReadLease struct {
+	mu      sync.Mutex
+	data    []byte
+	pos     int64
+	revoked bool
+}
+
+func (f *fakeReadLease) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.revoked {
+		return 0, &RevokedError{}
+	}
+
+	n, err := f.readAtLocked(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *fakeReadLease) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.revoked {
+		return 0, &RevokedError{}
+	}
+
+	return f.readAtLocked(p, off)
+}
+
+func (f *fakeReadLease) readAtLocked(p []byte, off int64) (int, error) {
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (f *fakeReadLease) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.revoked {
+		return 0, &RevokedError{}
+	}
+
+	switch whence {
+	case io.SeekStart:
+		f.pos = offset
+	case io.SeekCurrent:
+		f.pos += offset
+	case io.SeekEnd:
+		f.pos = int64(len(f.data)) + offset
+	}
+
+	return f.pos, nil
+}
+
+func (f *fakeReadLease) Upgrade() (ReadWriteLease, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.revoked {
+		return nil, &RevokedError{}
+	}
+
+	f.revoked = true
+	return &fakeReadWriteLease{data: f.data}, nil
+}
+
+func (f *fakeReadLease) Revoke() {
+	f.mu.Lock()
+	f.revoked = true
+	f.mu.Unlock()
+}
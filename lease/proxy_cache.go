@@ -0,0 +1,280 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sync/singleflight"
+)
+
+// Identifies the GCS object generation backing a read lease, so that
+// multiple file handles opened against the same generation can be told
+// apart from handles opened against a different one.
+type ProxyKey struct {
+	Bucket     string
+	Object     string
+	Generation int64
+}
+
+func (k ProxyKey) String() string {
+	return fmt.Sprintf("%s/%s@%d", k.Bucket, k.Object, k.Generation)
+}
+
+// A cache of read leases, keyed by the GCS object generation they proxy, so
+// that N file handles opened against the same generation share a single
+// on-disk copy and a single in-flight download rather than paying for each
+// independently. This is a natural fit for gcsfuse, which frequently has
+// several open file descriptors backed by the same object generation.
+type ProxyCache struct {
+	mu sync.Mutex
+
+	leaser FileLeaser
+
+	// Ensures that only one refresh is in flight per key at a time, even
+	// across the handles sharing that key's entry.
+	refreshes singleflight.Group
+
+	// GUARDED_BY(mu)
+	entries map[ProxyKey]*cachedProxy
+}
+
+// Create an empty proxy cache that allocates backing leases through fl.
+func NewProxyCache(fl FileLeaser) *ProxyCache {
+	return &ProxyCache{
+		leaser:  fl,
+		entries: make(map[ProxyKey]*cachedProxy),
+	}
+}
+
+// The shared state behind every handle sharing a given key.
+type cachedProxy struct {
+	// The underlying lease. cacheHandle takes only read locks on rwMu, so
+	// rwMu itself doesn't serialize concurrent readers; the underlying lease
+	// still takes its own exclusive lock on every call, so concurrent reads
+	// through handles sharing it are serialized there.
+	rwMu  sync.RWMutex
+	lease ReadLease
+
+	// GUARDED_BY(cache.mu)
+	refCount int
+}
+
+// Return a read lease for the given key, creating the shared backing lease
+// with refresh if this is the first request for it. The caller must call
+// Destroy on the result exactly once when finished with it; the shared
+// backing lease is only revoked once every handle sharing it has done so.
+func (c *ProxyCache) GetOrCreate(
+	key ProxyKey,
+	size int64,
+	refresh RefreshContentsFunc) (rl ReadLease) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &cachedProxy{
+			lease: NewReadProxy(c.leaser, size, c.dedupedRefresh(key, refresh)),
+		}
+		c.entries[key] = entry
+	}
+
+	entry.refCount++
+
+	rl = &cacheHandle{
+		cache: c,
+		key:   key,
+		entry: entry,
+	}
+
+	return
+}
+
+// Wrap refresh so that concurrent refreshes for the same key collapse into
+// a single call, via c.refreshes. This is what lets N handles sharing a key
+// avoid N simultaneous downloads when their common backing lease is
+// evicted and re-fetched.
+//
+// singleflight.Do hands its result to every caller that coalesced on the
+// in-flight call, so the function passed to it must not return a live,
+// single-use io.ReadCloser; two callers reading (or closing) the same one
+// would race. Instead it spools refresh's reader into a scratch lease of
+// our own -- these objects are routinely multi-GB, so buffering the whole
+// thing in memory isn't an option -- and each caller gets back its own
+// io.ReadCloser reading that lease independently via ReadAt.
+func (c *ProxyCache) dedupedRefresh(
+	key ProxyKey,
+	refresh RefreshContentsFunc) RefreshContentsFunc {
+	return func(ctx context.Context) (rc io.ReadCloser, err error) {
+		v, err, _ := c.refreshes.Do(key.String(), func() (interface{}, error) {
+			return c.fetchToScratchLease(ctx, refresh)
+		})
+		if err != nil {
+			return
+		}
+
+		rc = &leaseReader{lease: v.(ReadLease)}
+		return
+	}
+}
+
+// Run refresh and copy its result into a scratch lease allocated from
+// c.leaser, rather than buffering it in memory. The returned lease is never
+// explicitly revoked here; like any other lease, it's reclaimed by the file
+// leaser's own eviction policy once it falls out of use.
+func (c *ProxyCache) fetchToScratchLease(
+	ctx context.Context,
+	refresh RefreshContentsFunc) (rl ReadLease, err error) {
+	rwl, err := c.leaser.NewFile()
+	if err != nil {
+		err = fmt.Errorf("NewFile: %v", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			destroyReadWriteLease(rwl)
+		}
+	}()
+
+	src, err := refresh(ctx)
+	if err != nil {
+		err = fmt.Errorf("refresh: %v", err)
+		return
+	}
+
+	defer func() {
+		closeErr := src.Close()
+		if closeErr != nil && err == nil {
+			err = fmt.Errorf("Close: %v", closeErr)
+		}
+	}()
+
+	if _, err = copyWithContext(ctx, rwl, src); err != nil {
+		err = fmt.Errorf("Copy: %v", err)
+		return
+	}
+
+	rl, err = rwl.Downgrade()
+	if err != nil {
+		err = fmt.Errorf("Downgrade: %v", err)
+		return
+	}
+
+	return
+}
+
+// Adapts a ReadLease, safe to read from multiple independent callers via
+// ReadAt, into the single-use io.ReadCloser shape a RefreshContentsFunc
+// returns.
+type leaseReader struct {
+	lease ReadLease
+	off   int64
+}
+
+func (r *leaseReader) Read(p []byte) (n int, err error) {
+	n, err = r.lease.ReadAt(p, r.off)
+	r.off += int64(n)
+	return
+}
+
+func (r *leaseReader) Close() error {
+	return nil
+}
+
+// Drop a reference to the entry for key, revoking its backing lease once
+// the last reference is gone.
+func (c *ProxyCache) release(key ProxyKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return
+	}
+
+	entry.refCount--
+	if entry.refCount > 0 {
+		return
+	}
+
+	delete(c.entries, key)
+	entry.lease.Destroy()
+}
+
+// A handle to a cache entry, implementing ReadLease by reading through to
+// the shared underlying lease under entry.rwMu rather than serializing on
+// any lock of its own.
+type cacheHandle struct {
+	cache *ProxyCache
+	key   ProxyKey
+	entry *cachedProxy
+}
+
+func (h *cacheHandle) Read(ctx context.Context, p []byte) (n int, err error) {
+	h.entry.rwMu.RLock()
+	defer h.entry.rwMu.RUnlock()
+
+	n, err = h.entry.lease.Read(ctx, p)
+	return
+}
+
+func (h *cacheHandle) Seek(
+	ctx context.Context,
+	offset int64,
+	whence int) (off int64, err error) {
+	h.entry.rwMu.RLock()
+	defer h.entry.rwMu.RUnlock()
+
+	off, err = h.entry.lease.Seek(ctx, offset, whence)
+	return
+}
+
+func (h *cacheHandle) ReadAt(
+	ctx context.Context,
+	p []byte,
+	off int64) (n int, err error) {
+	h.entry.rwMu.RLock()
+	defer h.entry.rwMu.RUnlock()
+
+	n, err = h.entry.lease.ReadAt(ctx, p, off)
+	return
+}
+
+func (h *cacheHandle) Size() (size int64) {
+	return h.entry.lease.Size()
+}
+
+// Upgrade is not supported on a cache handle: h.entry.lease is shared by
+// every handle sharing h.key, and Upgrade permanently revokes the ReadLease
+// it's called on. Allowing it through here would pull the backing file out
+// from under every sibling handle the moment any one of them asked to write,
+// with no way to hand them a replacement. Callers that need read/write
+// access should read the bytes they need through this handle and write them
+// to a lease of their own instead.
+func (h *cacheHandle) Upgrade(
+	ctx context.Context) (rwl ReadWriteLease, err error) {
+	err = fmt.Errorf("Upgrade is not supported on a shared cache handle")
+	return
+}
+
+// Drop this handle's reference to the shared lease. The handle must not be
+// used after calling this method.
+func (h *cacheHandle) Destroy() {
+	h.cache.release(h.key)
+}
@@ -0,0 +1,164 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestGetOrCreate_SharesBackingLeaseAndRefresh(t *testing.T) {
+	cache := NewProxyCache(&fakeFileLeaser{})
+	key := ProxyKey{Bucket: "b", Object: "o", Generation: 1}
+
+	content := []byte("hello world")
+	var refreshes int32
+	refresh := func(ctx context.Context) (io.ReadCloser, error) {
+		atomic.AddInt32(&refreshes, 1)
+		return ioutil.NopCloser(bytes.NewReader(content)), nil
+	}
+
+	h1 := cache.GetOrCreate(key, int64(len(content)), refresh)
+	h2 := cache.GetOrCreate(key, int64(len(content)), refresh)
+
+	if len(cache.entries) != 1 {
+		t.Fatalf("len(cache.entries) = %d, want 1", len(cache.entries))
+	}
+
+	if got := cache.entries[key].refCount; got != 2 {
+		t.Fatalf("refCount = %d, want 2", got)
+	}
+
+	buf := make([]byte, len(content))
+	if _, err := h1.ReadAt(context.Background(), buf, 0); err != nil {
+		t.Fatalf("h1.ReadAt: %v", err)
+	}
+
+	if _, err := h2.ReadAt(context.Background(), buf, 0); err != nil {
+		t.Fatalf("h2.ReadAt: %v", err)
+	}
+
+	if got := atomic.LoadInt32(&refreshes); got != 1 {
+		t.Errorf("refresh called %d times, want 1", got)
+	}
+}
+
+func TestRelease_DestroysOnlyAtZeroRefcount(t *testing.T) {
+	cache := NewProxyCache(&fakeFileLeaser{})
+	key := ProxyKey{Bucket: "b", Object: "o", Generation: 1}
+
+	content := []byte("hello")
+	refresh := func(ctx context.Context) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(content)), nil
+	}
+
+	h1 := cache.GetOrCreate(key, int64(len(content)), refresh)
+	h2 := cache.GetOrCreate(key, int64(len(content)), refresh)
+
+	entry := cache.entries[key]
+	lease := entry.lease.(*autoRefreshingReadLease)
+
+	h1.Destroy()
+
+	if _, ok := cache.entries[key]; !ok {
+		t.Fatal("entry evicted after releasing only one of two references")
+	}
+
+	if lease.revoked {
+		t.Fatal("lease revoked after releasing only one of two references")
+	}
+
+	h2.Destroy()
+
+	if _, ok := cache.entries[key]; ok {
+		t.Fatal("entry not evicted after releasing the last reference")
+	}
+
+	if !lease.revoked {
+		t.Fatal("lease not revoked after releasing the last reference")
+	}
+}
+
+func TestDedupedRefresh_CollapsesConcurrentCalls(t *testing.T) {
+	cache := NewProxyCache(&fakeFileLeaser{})
+	key := ProxyKey{Bucket: "b", Object: "o", Generation: 1}
+
+	content := []byte("hello world")
+	var calls int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	refresh := func(ctx context.Context) (io.ReadCloser, error) {
+		atomic.AddInt32(&calls, 1)
+		close(started)
+		<-release
+		return ioutil.NopCloser(bytes.NewReader(content)), nil
+	}
+
+	deduped := cache.dedupedRefresh(key, refresh)
+
+	var wg sync.WaitGroup
+	results := make([]io.ReadCloser, 2)
+	errs := make([]error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = deduped(context.Background())
+		}(i)
+	}
+
+	<-started
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("underlying refresh called %d times, want 1", got)
+	}
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+
+		got, err := ioutil.ReadAll(results[i])
+		if err != nil {
+			t.Fatalf("call %d: ReadAll: %v", i, err)
+		}
+
+		if !bytes.Equal(got, content) {
+			t.Errorf("call %d: got %q, want %q", i, got, content)
+		}
+	}
+}
+
+func TestCacheHandleUpgrade_Rejected(t *testing.T) {
+	cache := NewProxyCache(&fakeFileLeaser{})
+	key := ProxyKey{Bucket: "b", Object: "o", Generation: 1}
+
+	h := cache.GetOrCreate(key, 0, func(ctx context.Context) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	})
+
+	if _, err := h.Upgrade(context.Background()); err == nil {
+		t.Fatal("Upgrade succeeded on a shared cache handle; want an error")
+	}
+}
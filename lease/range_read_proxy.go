@@ -0,0 +1,405 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// A function used by range read proxies to fetch a sub-range of their
+// contents, [off, off+limit-off). See notes on NewRangeReadProxy.
+type RangeRefreshFunc func(
+	ctx context.Context,
+	off int64,
+	limit int64) (io.ReadCloser, error)
+
+// Create a read lease whose contents are fetched lazily and in pieces: each
+// ReadAt fetches only the byte ranges it needs that haven't already been
+// populated, via refresh, rather than re-downloading the whole object the
+// way the lease returned by NewReadProxy does. This suits random-access
+// workloads (e.g. mmap of a large archive) where most of the object is
+// never touched.
+//
+// The resulting lease tracks which byte ranges of its backing file are
+// populated in a sorted, non-overlapping run-list. Destroy clears the
+// run-list and releases the backing file; reads after that return a
+// RevokedError rather than re-fetching from refresh.
+func NewRangeReadProxy(
+	fl FileLeaser,
+	size int64,
+	refresh RangeRefreshFunc) (rl ReadLease) {
+	rl = &rangeReadLease{
+		leaser:  fl,
+		size:    size,
+		refresh: refresh,
+	}
+
+	return
+}
+
+// A half-open byte range [off, limit).
+type byteRange struct {
+	off   int64
+	limit int64
+}
+
+func (r byteRange) len() int64 {
+	return r.limit - r.off
+}
+
+// Return the sub-ranges of [off, limit) that are not covered by any
+// range in runs. runs must be sorted and non-overlapping.
+func missingRanges(runs []byteRange, off int64, limit int64) (missing []byteRange) {
+	cursor := off
+	for _, r := range runs {
+		if r.limit <= cursor {
+			continue
+		}
+
+		if r.off >= limit {
+			break
+		}
+
+		if r.off > cursor {
+			missing = append(missing, byteRange{off: cursor, limit: r.off})
+		}
+
+		if r.limit > cursor {
+			cursor = r.limit
+		}
+
+		if cursor >= limit {
+			break
+		}
+	}
+
+	if cursor < limit {
+		missing = append(missing, byteRange{off: cursor, limit: limit})
+	}
+
+	return
+}
+
+// Insert r into the sorted, non-overlapping run-list runs, merging with any
+// ranges it overlaps or abuts, and return the resulting sorted,
+// non-overlapping run-list.
+func mergeRange(runs []byteRange, r byteRange) []byteRange {
+	merged := make([]byteRange, 0, len(runs)+1)
+	inserted := false
+
+	for _, existing := range runs {
+		switch {
+		case existing.limit < r.off:
+			merged = append(merged, existing)
+
+		case existing.off > r.limit:
+			if !inserted {
+				merged = append(merged, r)
+				inserted = true
+			}
+			merged = append(merged, existing)
+
+		default:
+			// Overlaps or abuts r; fold it in.
+			if existing.off < r.off {
+				r.off = existing.off
+			}
+			if existing.limit > r.limit {
+				r.limit = existing.limit
+			}
+		}
+	}
+
+	if !inserted {
+		merged = append(merged, r)
+	}
+
+	return merged
+}
+
+// A read lease that fetches its contents in sparse pieces, as described by
+// NewRangeReadProxy.
+type rangeReadLease struct {
+	mu sync.Mutex
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	size int64
+
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	leaser  FileLeaser
+	refresh RangeRefreshFunc
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	// Set to true when we've been permanently revoked.
+	//
+	// GUARDED_BY(mu)
+	revoked bool
+
+	// The backing file holding whatever bytes we've fetched so far, or nil
+	// if we've never needed one.
+	//
+	// GUARDED_BY(mu)
+	backing ReadWriteLease
+
+	// The byte ranges of backing that are populated, sorted and
+	// non-overlapping.
+	//
+	// GUARDED_BY(mu)
+	populated []byteRange
+
+	// The current offset for Read and Seek.
+	//
+	// GUARDED_BY(mu)
+	off int64
+}
+
+// Ensure we have a backing file, creating one if necessary.
+//
+// LOCKS_REQUIRED(rl.mu)
+func (rl *rangeReadLease) ensureBacking() (err error) {
+	if rl.backing != nil {
+		return
+	}
+
+	rl.backing, err = rl.leaser.NewFile()
+	if err != nil {
+		err = fmt.Errorf("NewFile: %v", err)
+		return
+	}
+
+	return
+}
+
+// Fetch [r.off, r.limit) via rl.refresh and write it into rl.backing at the
+// matching offset, then record it as populated.
+//
+// rl.mu is released around the call to rl.refresh, which may block for a
+// long time (e.g. a GCS range read), so that it doesn't serialize reads of
+// other, disjoint ranges behind it or make a concurrent Destroy or Upgrade
+// wait on it; see the equivalent note in autoRefreshingReadLease.Read.
+// rl.backing is re-validated after reacquiring the lock, since it may have
+// been revoked or handed off to an Upgrade caller while we were unlocked.
+//
+// LOCKS_REQUIRED(rl.mu)
+func (rl *rangeReadLease) fetchRange(ctx context.Context, r byteRange) (err error) {
+	backing := rl.backing
+	rl.mu.Unlock()
+
+	buf, fetchErr := rl.fetchRangeContents(ctx, r)
+
+	rl.mu.Lock()
+
+	if fetchErr != nil {
+		err = fetchErr
+		return
+	}
+
+	if rl.revoked || rl.backing != backing {
+		err = &RevokedError{}
+		return
+	}
+
+	if _, err = rl.backing.WriteAt(buf, r.off); err != nil {
+		err = fmt.Errorf("WriteAt: %v", err)
+		return
+	}
+
+	rl.populated = mergeRange(rl.populated, r)
+
+	return
+}
+
+// Fetch and return the contents of [r.off, r.limit) via rl.refresh, without
+// touching any of rl's state.
+//
+// LOCKS_EXCLUDED(rl.mu)
+func (rl *rangeReadLease) fetchRangeContents(ctx context.Context, r byteRange) (buf []byte, err error) {
+	rc, err := rl.refresh(ctx, r.off, r.limit)
+	if err != nil {
+		err = fmt.Errorf("refresh: %v", err)
+		return
+	}
+
+	defer func() {
+		closeErr := rc.Close()
+		if closeErr != nil && err == nil {
+			err = fmt.Errorf("Close: %v", closeErr)
+		}
+	}()
+
+	buf = make([]byte, r.len())
+	if _, err = io.ReadFull(rc, buf); err != nil {
+		err = fmt.Errorf("ReadFull: %v", err)
+		return
+	}
+
+	return
+}
+
+// Fill in any sub-ranges of [off, off+len(p)) that aren't already
+// populated, then serve the read from rl.backing. rl.mu is released around
+// each individual fetch (see the note on fetchRange), so other callers can
+// interleave reads of disjoint ranges, or a Destroy, between them.
+//
+// LOCKS_REQUIRED(rl.mu)
+func (rl *rangeReadLease) readAtLocked(
+	ctx context.Context,
+	p []byte,
+	off int64) (n int, err error) {
+	if rl.revoked {
+		err = &RevokedError{}
+		return
+	}
+
+	limit := off + int64(len(p))
+	if limit > rl.size {
+		limit = rl.size
+	}
+
+	if err = rl.ensureBacking(); err != nil {
+		return
+	}
+
+	for _, missing := range missingRanges(rl.populated, off, limit) {
+		if err = rl.fetchRange(ctx, missing); err != nil {
+			return
+		}
+	}
+
+	n, err = rl.backing.ReadAt(p, off)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Public interface
+////////////////////////////////////////////////////////////////////////
+
+// Semantics matching io.ReaderAt, except with context support.
+func (rl *rangeReadLease) ReadAt(
+	ctx context.Context,
+	p []byte,
+	off int64) (n int, err error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	n, err = rl.readAtLocked(ctx, p, off)
+	return
+}
+
+// Semantics matching io.Reader, except with context support.
+func (rl *rangeReadLease) Read(
+	ctx context.Context,
+	p []byte) (n int, err error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	n, err = rl.readAtLocked(ctx, p, rl.off)
+	rl.off += int64(n)
+
+	return
+}
+
+// Semantics matching io.Seeker, except with context support.
+func (rl *rangeReadLease) Seek(
+	ctx context.Context,
+	offset int64,
+	whence int) (off int64, err error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+		rl.off = offset
+	case io.SeekCurrent:
+		rl.off += offset
+	case io.SeekEnd:
+		rl.off = rl.size + offset
+	default:
+		err = fmt.Errorf("unknown whence: %d", whence)
+		return
+	}
+
+	off = rl.off
+	return
+}
+
+// Return the size of the proxied content. Guarantees to not block.
+func (rl *rangeReadLease) Size() (size int64) {
+	size = rl.size
+	return
+}
+
+// For testing use only; do not touch.
+func (rl *rangeReadLease) Destroyed() (destroyed bool) {
+	panic("TODO")
+}
+
+// Return a read/write lease for the proxied contents, fetching any
+// not-yet-populated ranges first. The read proxy must not be used after
+// calling this method.
+func (rl *rangeReadLease) Upgrade(
+	ctx context.Context) (rwl ReadWriteLease, err error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.revoked {
+		err = &RevokedError{}
+		return
+	}
+
+	if err = rl.ensureBacking(); err != nil {
+		return
+	}
+
+	for _, missing := range missingRanges(rl.populated, 0, rl.size) {
+		if err = rl.fetchRange(ctx, missing); err != nil {
+			return
+		}
+	}
+
+	rl.revoked = true
+	rwl = rl.backing
+	rl.backing = nil
+
+	return
+}
+
+// Destroy any resources in use by the read proxy. It must not be used
+// further.
+func (rl *rangeReadLease) Destroy() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.revoked = true
+	rl.populated = nil
+
+	if rl.backing != nil {
+		destroyReadWriteLease(rl.backing)
+		rl.backing = nil
+	}
+}
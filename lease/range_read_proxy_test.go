@@ -0,0 +1,122 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMissingRanges(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		runs    []byteRange
+		off     int64
+		limit   int64
+		missing []byteRange
+	}{
+		{
+			desc:    "no runs at all",
+			runs:    nil,
+			off:     0,
+			limit:   10,
+			missing: []byteRange{{off: 0, limit: 10}},
+		},
+		{
+			desc:    "fully covered",
+			runs:    []byteRange{{off: 0, limit: 10}},
+			off:     2,
+			limit:   8,
+			missing: nil,
+		},
+		{
+			desc:    "gap before and after a single run",
+			runs:    []byteRange{{off: 4, limit: 6}},
+			off:     0,
+			limit:   10,
+			missing: []byteRange{{off: 0, limit: 4}, {off: 6, limit: 10}},
+		},
+		{
+			desc:    "gap between two runs",
+			runs:    []byteRange{{off: 0, limit: 2}, {off: 8, limit: 10}},
+			off:     0,
+			limit:   10,
+			missing: []byteRange{{off: 2, limit: 8}},
+		},
+		{
+			desc:    "run starting exactly at limit is irrelevant",
+			runs:    []byteRange{{off: 10, limit: 20}},
+			off:     0,
+			limit:   10,
+			missing: []byteRange{{off: 0, limit: 10}},
+		},
+	}
+
+	for _, tc := range testCases {
+		got := missingRanges(tc.runs, tc.off, tc.limit)
+		if !reflect.DeepEqual(got, tc.missing) {
+			t.Errorf("%s: missingRanges(%v, %d, %d) = %v, want %v",
+				tc.desc, tc.runs, tc.off, tc.limit, got, tc.missing)
+		}
+	}
+}
+
+func TestMergeRange(t *testing.T) {
+	testCases := []struct {
+		desc string
+		runs []byteRange
+		r    byteRange
+		want []byteRange
+	}{
+		{
+			desc: "into an empty run-list",
+			runs: nil,
+			r:    byteRange{off: 0, limit: 10},
+			want: []byteRange{{off: 0, limit: 10}},
+		},
+		{
+			desc: "disjoint, inserted in order",
+			runs: []byteRange{{off: 0, limit: 10}},
+			r:    byteRange{off: 20, limit: 30},
+			want: []byteRange{{off: 0, limit: 10}, {off: 20, limit: 30}},
+		},
+		{
+			desc: "overlapping is folded in",
+			runs: []byteRange{{off: 0, limit: 10}},
+			r:    byteRange{off: 5, limit: 15},
+			want: []byteRange{{off: 0, limit: 15}},
+		},
+		{
+			desc: "abutting is folded in",
+			runs: []byteRange{{off: 0, limit: 10}},
+			r:    byteRange{off: 10, limit: 20},
+			want: []byteRange{{off: 0, limit: 20}},
+		},
+		{
+			desc: "bridges two existing runs into one",
+			runs: []byteRange{{off: 0, limit: 5}, {off: 15, limit: 20}},
+			r:    byteRange{off: 5, limit: 15},
+			want: []byteRange{{off: 0, limit: 20}},
+		},
+	}
+
+	for _, tc := range testCases {
+		got := mergeRange(tc.runs, tc.r)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: mergeRange(%v, %v) = %v, want %v",
+				tc.desc, tc.runs, tc.r, got, tc.want)
+		}
+	}
+}
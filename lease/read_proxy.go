@@ -15,7 +15,12 @@
 package lease
 
 import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"log"
 	"sync"
@@ -23,9 +28,28 @@ import (
 	"golang.org/x/net/context"
 )
 
-// A function used by read proxies to refresh their contents. See notes on
-// NewReadProxy.
-type RefreshContentsFunc func(context.Context) (io.ReadCloser, error)
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// A function used by read proxies to refresh their contents. The context is
+// threaded into the underlying fetch (e.g. the GCS request behind it), so
+// that a caller who cancels a read can actually abort an in-flight refresh
+// rather than merely abandoning the result. See notes on NewReadProxy.
+type RefreshContentsFunc func(ctx context.Context) (io.ReadCloser, error)
+
+// Deprecated: use RefreshContentsFunc, which is cancellable via the context
+// it's passed. Kept so that an existing caller with a func() (io.ReadCloser,
+// error) value can still construct a read proxy, via AsRefreshContentsFunc,
+// without itself being rewritten to accept a context.
+type DeprecatedRefreshContentsFunc func() (io.ReadCloser, error)
+
+// Adapt f into a RefreshContentsFunc, for passing to NewReadProxy or
+// NewReadProxyWithDigest. ctx is ignored; a refresh obtained this way cannot
+// be canceled once started.
+func (f DeprecatedRefreshContentsFunc) AsRefreshContentsFunc() RefreshContentsFunc {
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		return f()
+	}
+}
 
 // Create a read proxy.
 //
@@ -37,11 +61,40 @@ func NewReadProxy(
 	fl FileLeaser,
 	size int64,
 	refresh RefreshContentsFunc) (rl ReadLease) {
-	rl = &autoRefreshingReadLease{
+	a := &autoRefreshingReadLease{
 		leaser:  fl,
 		size:    size,
 		refresh: refresh,
 	}
+	a.cond = sync.NewCond(&a.mu)
+	rl = a
+
+	return
+}
+
+// Like NewReadProxy, but additionally verifies each (re)fetch of the
+// content against the crc32c GCS reported for the object when it was
+// opened (and, if supplied, its md5). If the object was overwritten
+// between the original open and a subsequent lease-refresh, the refresh's
+// bytes won't match and getContents returns a *DigestMismatchError instead
+// of silently serving a mix of old and new bytes. Pass a nil md5 to skip
+// that check.
+func NewReadProxyWithDigest(
+	fl FileLeaser,
+	size int64,
+	crc32c uint32,
+	md5 []byte,
+	refresh RefreshContentsFunc) (rl ReadLease) {
+	a := &autoRefreshingReadLease{
+		leaser:         fl,
+		size:           size,
+		refresh:        refresh,
+		checkDigest:    true,
+		expectedCRC32C: crc32c,
+		expectedMD5:    md5,
+	}
+	a.cond = sync.NewCond(&a.mu)
+	rl = a
 
 	return
 }
@@ -55,9 +108,16 @@ func NewReadProxy(
 //  *  Methods that may involve fetching the contents (reading, seeking) accept
 //     context arguments, so as to be cancellable.
 //
-type ReadProxy struct {
+type autoRefreshingReadLease struct {
 	mu sync.Mutex
 
+	// Signalled whenever refreshing transitions to false, so that callers
+	// who found a refresh already in progress can wake up and either reuse
+	// its result or start their own.
+	//
+	// GUARDED_BY(mu)
+	cond *sync.Cond
+
 	/////////////////////////
 	// Constant data
 	/////////////////////////
@@ -68,8 +128,15 @@ type ReadProxy struct {
 	// Dependencies
 	/////////////////////////
 
-	leaser FileLeaser
-	f      func() (io.ReadCloser, error)
+	leaser  FileLeaser
+	refresh RefreshContentsFunc
+
+	// Whether getContents should verify the fetched content's digest
+	// against expectedCRC32C (and expectedMD5, if non-nil). Set only by
+	// NewReadProxyWithDigest.
+	checkDigest    bool
+	expectedCRC32C uint32
+	expectedMD5    []byte
 
 	/////////////////////////
 	// Mutable state
@@ -84,12 +151,27 @@ type ReadProxy struct {
 	//
 	// GUARDED_BY(mu)
 	wrapped ReadLease
+
+	// Whether a call to getContents is currently in flight for this lease.
+	// Serializes concurrent refreshes so that at most one is ever running,
+	// which in turn means saveContents is only ever called by one goroutine
+	// at a time: without this, two callers racing into getContents because
+	// both observed wrapped == nil could each succeed and clobber one
+	// another's result, leaking the loser's backing file.
+	//
+	// GUARDED_BY(mu)
+	refreshing bool
 }
 
 ////////////////////////////////////////////////////////////////////////
 // Helpers
 ////////////////////////////////////////////////////////////////////////
 
+// The chunk size used by the cancellable copy loop in getContents. Small
+// enough that a cancelled context is noticed promptly even against a slow
+// source, large enough to keep syscall overhead down.
+const getContentsCopyChunkSize = 1 << 20 // 1 MiB
+
 // Attempt to clean up after the supplied read/write lease.
 func destroyReadWriteLease(rwl ReadWriteLease) {
 	var err error
@@ -115,13 +197,76 @@ func isRevokedErr(err error) bool {
 	return ok
 }
 
-// Set up a read/write lease and fill in our contents.
-//
-// REQUIRES: The caller has observed that rl.lease has expired.
+// Returned by getContents when a lease created with NewReadProxyWithDigest
+// fetches content whose digest doesn't match what was expected, indicating
+// the underlying GCS object was overwritten between the original open and
+// this lease refresh. Read, Seek, ReadAt, and Upgrade do not return this type
+// as is: they wrap getContents's error with fmt.Errorf, so their callers see
+// only its message.
+type DigestMismatchError struct {
+	// "crc32c" or "md5".
+	Kind string
+
+	Expected []byte
+	Actual   []byte
+}
+
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf(
+		"%s mismatch: expected %x, got %x (object changed underneath us?)",
+		e.Kind, e.Expected, e.Actual)
+}
+
+// Copy src into dst in chunks, checking ctx between each one so a cancelled
+// context is honored partway through a large copy instead of only before or
+// after it. Returns ctx.Err(), unwrapped, if cancellation is what stopped us.
+func copyWithContext(
+	ctx context.Context,
+	dst io.Writer,
+	src io.Reader) (copied int64, err error) {
+	buf := make([]byte, getContentsCopyChunkSize)
+
+	for {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+
+		default:
+		}
+
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			written, writeErr := dst.Write(buf[:n])
+			copied += int64(written)
+			if writeErr != nil {
+				err = writeErr
+				return
+			}
+
+			if written != n {
+				err = io.ErrShortWrite
+				return
+			}
+		}
+
+		if readErr != nil {
+			if readErr != io.EOF {
+				err = readErr
+			}
+			return
+		}
+	}
+}
+
+// Set up a read/write lease and fill in our contents, honoring cancellation
+// of ctx both while waiting on rl.refresh and while copying its result into
+// the new lease. On cancellation, the partially written lease is destroyed
+// and ctx.Err() is returned.
 //
-// LOCKS_REQUIRED(rl.mu)
-func (rl *autoRefreshingReadLease) getContents() (
-	rwl ReadWriteLease, err error) {
+// LOCKS_EXCLUDED(rl.mu)
+func (rl *autoRefreshingReadLease) getContents(
+	ctx context.Context) (rwl ReadWriteLease, err error) {
 	// Obtain some space to write the contents.
 	rwl, err = rl.leaser.NewFile()
 	if err != nil {
@@ -137,8 +282,13 @@ func (rl *autoRefreshingReadLease) getContents() (
 	}()
 
 	// Obtain the reader for our contents.
-	rc, err := rl.f()
+	rc, err := rl.refresh(ctx)
 	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+			return
+		}
+
 		err = fmt.Errorf("User function: %v", err)
 		return
 	}
@@ -150,10 +300,33 @@ func (rl *autoRefreshingReadLease) getContents() (
 		}
 	}()
 
-	// Copy into the read/write lease.
-	copied, err := io.Copy(rwl, rc)
+	// If requested, tee the bytes we copy through digest hashes so we can
+	// detect the object having been mutated underneath us.
+	src := io.Reader(rc)
+
+	var crc32cHash hash.Hash32
+	var md5Hash hash.Hash
+	if rl.checkDigest {
+		var tees []io.Writer
+
+		crc32cHash = crc32.New(crc32cTable)
+		tees = append(tees, crc32cHash)
+
+		if rl.expectedMD5 != nil {
+			md5Hash = md5.New()
+			tees = append(tees, md5Hash)
+		}
+
+		src = io.TeeReader(rc, io.MultiWriter(tees...))
+	}
+
+	// Copy into the read/write lease, checking ctx between chunks rather
+	// than blocking uninterruptibly on the whole object.
+	copied, err := copyWithContext(ctx, rwl, src)
 	if err != nil {
-		err = fmt.Errorf("Copy: %v", err)
+		if err != ctx.Err() {
+			err = fmt.Errorf("Copy: %v", err)
+		}
 		return
 	}
 
@@ -163,11 +336,42 @@ func (rl *autoRefreshingReadLease) getContents() (
 		return
 	}
 
+	// Did the object change underneath us?
+	if crc32cHash != nil {
+		actual := crc32cHash.Sum32()
+		if actual != rl.expectedCRC32C {
+			expectedBytes := make([]byte, 4)
+			actualBytes := make([]byte, 4)
+			binary.BigEndian.PutUint32(expectedBytes, rl.expectedCRC32C)
+			binary.BigEndian.PutUint32(actualBytes, actual)
+
+			err = &DigestMismatchError{
+				Kind:     "crc32c",
+				Expected: expectedBytes,
+				Actual:   actualBytes,
+			}
+			return
+		}
+	}
+
+	if md5Hash != nil {
+		actual := md5Hash.Sum(nil)
+		if !bytes.Equal(actual, rl.expectedMD5) {
+			err = &DigestMismatchError{
+				Kind:     "md5",
+				Expected: rl.expectedMD5,
+				Actual:   actual,
+			}
+			return
+		}
+	}
+
 	return
 }
 
 // Downgrade and save the supplied read/write lease obtained with getContents
-// for later use.
+// for later use, replacing (and destroying) whatever lease is currently
+// saved, if any.
 //
 // LOCKS_REQUIRED(rl.mu)
 func (rl *autoRefreshingReadLease) saveContents(rwl ReadWriteLease) {
@@ -177,6 +381,13 @@ func (rl *autoRefreshingReadLease) saveContents(rwl ReadWriteLease) {
 		return
 	}
 
+	// Belt and suspenders: rl.refreshing already ensures only one getContents
+	// runs at a time for this lease, so this should never be non-nil here,
+	// but don't leak a backing file if that invariant is ever violated.
+	if rl.wrapped != nil {
+		rl.wrapped.Revoke()
+	}
+
 	rl.wrapped = downgraded
 }
 
@@ -189,36 +400,79 @@ func (rl *autoRefreshingReadLease) Read(
 	ctx context.Context,
 	p []byte) (n int, err error) {
 	rl.mu.Lock()
-	defer rl.mu.Unlock()
 
 	// Special case: have we been permanently revoked?
 	if rl.revoked {
+		rl.mu.Unlock()
 		err = &RevokedError{}
 		return
 	}
 
-	// Common case: is the existing lease still valid?
+	// Common case: is the existing lease still valid? Served while holding
+	// rl.mu: this is a local, non-blocking operation against an on-disk
+	// file, so there's no reason to let two callers race on it.
 	if rl.wrapped != nil {
 		n, err = rl.wrapped.Read(p)
 		if !isRevokedErr(err) {
+			rl.mu.Unlock()
 			return
 		}
 
-		// Clear the revoked error.
+		// Clear the revoked error and fall through to arrange a refresh.
 		err = nil
+		rl.wrapped = nil
 	}
 
-	// Get hold of a read/write lease containing our contents.
-	rwl, err := rl.getContents()
-	if err != nil {
-		err = fmt.Errorf("getContents: %v", err)
+	// Wait out any refresh already in progress; it may have left us a
+	// usable rl.wrapped.
+	for rl.refreshing {
+		rl.cond.Wait()
+	}
+
+	if rl.revoked {
+		rl.mu.Unlock()
+		err = &RevokedError{}
+		return
+	}
+
+	if rl.wrapped != nil {
+		n, err = rl.wrapped.Read(p)
+		rl.mu.Unlock()
+		return
+	}
+
+	// We're the one responsible for refreshing. Release rl.mu only around
+	// getContents, which may block for a long time (e.g. a full object
+	// fetch); we don't want a concurrent Destroy or Upgrade to have to wait
+	// on us, and rl.refreshing keeps any other caller needing a refresh from
+	// racing into getContents alongside us.
+	rl.refreshing = true
+	rl.mu.Unlock()
+
+	rwl, fetchErr := rl.getContents(ctx)
+
+	rl.mu.Lock()
+	rl.refreshing = false
+	rl.cond.Broadcast()
+
+	if fetchErr != nil {
+		rl.mu.Unlock()
+		err = fmt.Errorf("getContents: %v", fetchErr)
+		return
+	}
+
+	if rl.revoked {
+		rl.mu.Unlock()
+		destroyReadWriteLease(rwl)
+		err = &RevokedError{}
 		return
 	}
 
-	defer rl.saveContents(rwl)
+	rl.saveContents(rwl)
 
 	// Serve from the read/write lease.
 	n, err = rwl.Read(p)
+	rl.mu.Unlock()
 
 	return
 }
@@ -229,36 +483,73 @@ func (rl *autoRefreshingReadLease) Seek(
 	offset int64,
 	whence int) (off int64, err error) {
 	rl.mu.Lock()
-	defer rl.mu.Unlock()
 
 	// Special case: have we been permanently revoked?
 	if rl.revoked {
+		rl.mu.Unlock()
 		err = &RevokedError{}
 		return
 	}
 
-	// Common case: is the existing lease still valid?
+	// Common case: is the existing lease still valid? See the note in Read
+	// above about serving this while holding rl.mu.
 	if rl.wrapped != nil {
 		off, err = rl.wrapped.Seek(offset, whence)
 		if !isRevokedErr(err) {
+			rl.mu.Unlock()
 			return
 		}
 
-		// Clear the revoked error.
 		err = nil
+		rl.wrapped = nil
 	}
 
-	// Get hold of a read/write lease containing our contents.
-	rwl, err := rl.getContents()
-	if err != nil {
-		err = fmt.Errorf("getContents: %v", err)
+	// See the note in Read above about waiting out an in-flight refresh.
+	for rl.refreshing {
+		rl.cond.Wait()
+	}
+
+	if rl.revoked {
+		rl.mu.Unlock()
+		err = &RevokedError{}
 		return
 	}
 
-	defer rl.saveContents(rwl)
+	if rl.wrapped != nil {
+		off, err = rl.wrapped.Seek(offset, whence)
+		rl.mu.Unlock()
+		return
+	}
+
+	// See the note in Read above about releasing rl.mu only around
+	// getContents.
+	rl.refreshing = true
+	rl.mu.Unlock()
+
+	rwl, fetchErr := rl.getContents(ctx)
+
+	rl.mu.Lock()
+	rl.refreshing = false
+	rl.cond.Broadcast()
+
+	if fetchErr != nil {
+		rl.mu.Unlock()
+		err = fmt.Errorf("getContents: %v", fetchErr)
+		return
+	}
+
+	if rl.revoked {
+		rl.mu.Unlock()
+		destroyReadWriteLease(rwl)
+		err = &RevokedError{}
+		return
+	}
+
+	rl.saveContents(rwl)
 
 	// Serve from the read/write lease.
 	off, err = rwl.Seek(offset, whence)
+	rl.mu.Unlock()
 
 	return
 }
@@ -269,36 +560,73 @@ func (rl *autoRefreshingReadLease) ReadAt(
 	p []byte,
 	off int64) (n int, err error) {
 	rl.mu.Lock()
-	defer rl.mu.Unlock()
 
 	// Special case: have we been permanently revoked?
 	if rl.revoked {
+		rl.mu.Unlock()
 		err = &RevokedError{}
 		return
 	}
 
-	// Common case: is the existing lease still valid?
+	// Common case: is the existing lease still valid? See the note in Read
+	// above about serving this while holding rl.mu.
 	if rl.wrapped != nil {
 		n, err = rl.wrapped.ReadAt(p, off)
 		if !isRevokedErr(err) {
+			rl.mu.Unlock()
 			return
 		}
 
-		// Clear the revoked error.
 		err = nil
+		rl.wrapped = nil
 	}
 
-	// Get hold of a read/write lease containing our contents.
-	rwl, err := rl.getContents()
-	if err != nil {
-		err = fmt.Errorf("getContents: %v", err)
+	// See the note in Read above about waiting out an in-flight refresh.
+	for rl.refreshing {
+		rl.cond.Wait()
+	}
+
+	if rl.revoked {
+		rl.mu.Unlock()
+		err = &RevokedError{}
+		return
+	}
+
+	if rl.wrapped != nil {
+		n, err = rl.wrapped.ReadAt(p, off)
+		rl.mu.Unlock()
 		return
 	}
 
-	defer rl.saveContents(rwl)
+	// See the note in Read above about releasing rl.mu only around
+	// getContents.
+	rl.refreshing = true
+	rl.mu.Unlock()
+
+	rwl, fetchErr := rl.getContents(ctx)
+
+	rl.mu.Lock()
+	rl.refreshing = false
+	rl.cond.Broadcast()
+
+	if fetchErr != nil {
+		rl.mu.Unlock()
+		err = fmt.Errorf("getContents: %v", fetchErr)
+		return
+	}
+
+	if rl.revoked {
+		rl.mu.Unlock()
+		destroyReadWriteLease(rwl)
+		err = &RevokedError{}
+		return
+	}
+
+	rl.saveContents(rwl)
 
 	// Serve from the read/write lease.
 	n, err = rwl.ReadAt(p, off)
+	rl.mu.Unlock()
 
 	return
 }
@@ -316,41 +644,80 @@ func (rl *autoRefreshingReadLease) Destroyed() (destroyed bool) {
 
 // Return a read/write lease for the proxied contents. The read proxy must not
 // be used after calling this method.
-func (rl *autoRefreshingReadLease) Upgrade() (rwl ReadWriteLease, err error) {
+func (rl *autoRefreshingReadLease) Upgrade(
+	ctx context.Context) (rwl ReadWriteLease, err error) {
 	rl.mu.Lock()
-	defer rl.mu.Unlock()
 
 	// Special case: have we been permanently revoked?
 	if rl.revoked {
+		rl.mu.Unlock()
 		err = &RevokedError{}
 		return
 	}
 
-	// If we succeed, we are now revoked.
-	defer func() {
-		if err == nil {
-			rl.revoked = true
-		}
-	}()
-
-	// Common case: is the existing lease still valid?
+	// Common case: is the existing lease still valid? See the note in Read
+	// above about serving this while holding rl.mu.
 	if rl.wrapped != nil {
 		rwl, err = rl.wrapped.Upgrade()
 		if !isRevokedErr(err) {
+			if err == nil {
+				rl.revoked = true
+			}
+			rl.mu.Unlock()
 			return
 		}
 
-		// Clear the revoked error.
 		err = nil
+		rl.wrapped = nil
 	}
 
-	// Build the read/write lease anew.
-	rwl, err = rl.getContents()
-	if err != nil {
-		err = fmt.Errorf("getContents: %v", err)
+	// See the note in Read above about waiting out an in-flight refresh.
+	for rl.refreshing {
+		rl.cond.Wait()
+	}
+
+	if rl.revoked {
+		rl.mu.Unlock()
+		err = &RevokedError{}
+		return
+	}
+
+	if rl.wrapped != nil {
+		rwl, err = rl.wrapped.Upgrade()
+		if err == nil {
+			rl.revoked = true
+		}
+		rl.mu.Unlock()
+		return
+	}
+
+	// See the note in Read above about releasing rl.mu only around
+	// getContents.
+	rl.refreshing = true
+	rl.mu.Unlock()
+
+	rwl, fetchErr := rl.getContents(ctx)
+
+	rl.mu.Lock()
+	rl.refreshing = false
+	rl.cond.Broadcast()
+
+	if fetchErr != nil {
+		rl.mu.Unlock()
+		err = fmt.Errorf("getContents: %v", fetchErr)
+		return
+	}
+
+	if rl.revoked {
+		rl.mu.Unlock()
+		destroyReadWriteLease(rwl)
+		err = &RevokedError{}
 		return
 	}
 
+	rl.revoked = true
+	rl.mu.Unlock()
+
 	return
 }
 
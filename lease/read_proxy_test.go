@@ -0,0 +1,175 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestCopyWithContext_CopiesEverything(t *testing.T) {
+	src := bytes.NewReader(bytes.Repeat([]byte("a"), 3*getContentsCopyChunkSize+1))
+	var dst bytes.Buffer
+
+	n, err := copyWithContext(context.Background(), &dst, src)
+	if err != nil {
+		t.Fatalf("copyWithContext: %v", err)
+	}
+
+	if n != int64(dst.Len()) {
+		t.Errorf("copied = %d, but dst has %d bytes", n, dst.Len())
+	}
+
+	if n != 3*getContentsCopyChunkSize+1 {
+		t.Errorf("copied = %d, want %d", n, 3*getContentsCopyChunkSize+1)
+	}
+}
+
+func TestCopyWithContext_HonorsCancellationMidCopy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// A reader that cancels ctx while serving its first chunk and would only
+	// report EOF on a second call, so a second call to src.Read would mean
+	// the cancellation went unnoticed.
+	chunks := 0
+	src := readerFunc(func(p []byte) (int, error) {
+		chunks++
+		if chunks == 1 {
+			for i := range p {
+				p[i] = 'a'
+			}
+			cancel()
+			return len(p), nil
+		}
+
+		return 0, io.EOF
+	})
+
+	_, err := copyWithContext(ctx, &bytes.Buffer{}, src)
+	if err != ctx.Err() {
+		t.Errorf("err = %v, want %v", err, ctx.Err())
+	}
+
+	if chunks != 1 {
+		t.Errorf("src was read %d times; want exactly 1 (no read after cancellation)", chunks)
+	}
+}
+
+func TestCopyWithContext_PropagatesWriteError(t *testing.T) {
+	someErr := io.ErrShortWrite
+	src := bytes.NewReader([]byte("hello"))
+	dst := errWriter{err: someErr}
+
+	_, err := copyWithContext(context.Background(), dst, src)
+	if err != someErr {
+		t.Errorf("err = %v, want %v", err, someErr)
+	}
+}
+
+func TestNewReadProxyWithDigest_TamperedBytesRejected(t *testing.T) {
+	original := bytes.Repeat([]byte("x"), 1<<16)
+	expectedCRC32C := crc32.Checksum(original, crc32cTable)
+
+	// Same length as original, but with one byte flipped, so a naive
+	// size-only check would pass.
+	tampered := append([]byte(nil), original...)
+	tampered[len(tampered)/2] ^= 0xff
+
+	refresh := func(ctx context.Context) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(tampered)), nil
+	}
+
+	rl := NewReadProxyWithDigest(
+		&fakeFileLeaser{}, int64(len(original)), expectedCRC32C, nil, refresh)
+	a := rl.(*autoRefreshingReadLease)
+
+	_, err := a.getContents(context.Background())
+	if err == nil {
+		t.Fatal("getContents succeeded; want a DigestMismatchError")
+	}
+
+	mismatch, ok := err.(*DigestMismatchError)
+	if !ok {
+		t.Fatalf("err = %#v, want *DigestMismatchError", err)
+	}
+
+	if mismatch.Kind != "crc32c" {
+		t.Errorf("mismatch.Kind = %q, want %q", mismatch.Kind, "crc32c")
+	}
+}
+
+func TestNewReadProxyWithDigest_MatchingDigestAccepted(t *testing.T) {
+	original := bytes.Repeat([]byte("x"), 1<<16)
+	expectedCRC32C := crc32.Checksum(original, crc32cTable)
+
+	refresh := func(ctx context.Context) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(original)), nil
+	}
+
+	rl := NewReadProxyWithDigest(
+		&fakeFileLeaser{}, int64(len(original)), expectedCRC32C, nil, refresh)
+	a := rl.(*autoRefreshingReadLease)
+
+	rwl, err := a.getContents(context.Background())
+	if err != nil {
+		t.Fatalf("getContents: %v", err)
+	}
+
+	got := make([]byte, len(original))
+	if _, err := rwl.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt: %v", err)
+	}
+
+	if !bytes.Equal(got, original) {
+		t.Errorf("contents did not round-trip through the read/write lease")
+	}
+}
+
+func TestDeprecatedRefreshContentsFunc_AsRefreshContentsFunc(t *testing.T) {
+	var called bool
+	dep := DeprecatedRefreshContentsFunc(func() (io.ReadCloser, error) {
+		called = true
+		return ioutil.NopCloser(bytes.NewReader([]byte("x"))), nil
+	})
+
+	rc, err := dep.AsRefreshContentsFunc()(context.Background())
+	if err != nil {
+		t.Fatalf("AsRefreshContentsFunc: %v", err)
+	}
+	defer rc.Close()
+
+	if !called {
+		t.Error("underlying DeprecatedRefreshContentsFunc was never invoked")
+	}
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+type errWriter struct {
+	err error
+}
+
+func (w errWriter) Write(p []byte) (int, error) {
+	return 0, w.err
+}
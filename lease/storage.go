@@ -0,0 +1,333 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Identifies a lease file within a LeaseStorage, stable across a Close and a
+// later Open.
+type LeaseID string
+
+// A single lease's backing file, as handed out by a LeaseStorage.
+type LeaseFile interface {
+	io.ReaderAt
+	io.WriterAt
+	io.ReadWriteSeeker
+	io.Closer
+
+	// Discard the file's current contents, resetting it to zero length.
+	Truncate() error
+
+	// The ID under which this file can later be re-opened with
+	// LeaseStorage.Open, once this handle has been closed.
+	ID() LeaseID
+}
+
+// An abstraction over where FileLeaser puts the bytes for the lease files it
+// hands out, so that alternative backends (e.g. compressed ones) can be
+// swapped in without FileLeaser itself knowing about them. Nothing in this
+// package passes a LeaseStorage to FileLeaser: FileLeaser does not call
+// Create, Open, or Remove. See NewLeaseStorage below for selecting one by
+// name.
+type LeaseStorage interface {
+	// Allocate a new, empty lease file.
+	Create() (LeaseFile, error)
+
+	// Re-open a lease file previously returned by Create (and since closed)
+	// by its ID.
+	Open(id LeaseID) (LeaseFile, error)
+
+	// Delete the lease file with the given ID. It must not be open.
+	Remove(id LeaseID) error
+}
+
+// Construct the LeaseStorage named by kind, placing its files in dir. No
+// mount flag in this package reads kind. Recognized values are "plain", for
+// TempDirStorage, and "zstd", for a TempDirStorage wrapped in
+// CompressedStorage.
+func NewLeaseStorage(kind string, dir string) (ls LeaseStorage, err error) {
+	switch kind {
+	case "plain":
+		ls = NewTempDirStorage(dir)
+
+	case "zstd":
+		ls = NewCompressedStorage(NewTempDirStorage(dir))
+
+	default:
+		err = fmt.Errorf("unknown lease storage kind: %q", kind)
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Temp directory backend
+////////////////////////////////////////////////////////////////////////
+
+// The storage backend FileLeaser has always used: raw lease bytes written
+// directly into scratch files in a single directory.
+type TempDirStorage struct {
+	dir string
+}
+
+// Create a storage backend that places lease files directly in dir.
+func NewTempDirStorage(dir string) *TempDirStorage {
+	return &TempDirStorage{dir: dir}
+}
+
+func (s *TempDirStorage) Create() (LeaseFile, error) {
+	f, err := ioutil.TempFile(s.dir, "lease")
+	if err != nil {
+		return nil, fmt.Errorf("TempFile: %v", err)
+	}
+
+	return &osLeaseFile{f: f}, nil
+}
+
+func (s *TempDirStorage) Open(id LeaseID) (LeaseFile, error) {
+	f, err := os.OpenFile(string(id), os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("OpenFile: %v", err)
+	}
+
+	return &osLeaseFile{f: f}, nil
+}
+
+func (s *TempDirStorage) Remove(id LeaseID) error {
+	return os.Remove(string(id))
+}
+
+type osLeaseFile struct {
+	f *os.File
+}
+
+func (f *osLeaseFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.f.ReadAt(p, off)
+}
+
+func (f *osLeaseFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.f.WriteAt(p, off)
+}
+
+func (f *osLeaseFile) Read(p []byte) (int, error) {
+	return f.f.Read(p)
+}
+
+func (f *osLeaseFile) Write(p []byte) (int, error) {
+	return f.f.Write(p)
+}
+
+func (f *osLeaseFile) Seek(offset int64, whence int) (int64, error) {
+	return f.f.Seek(offset, whence)
+}
+
+func (f *osLeaseFile) Truncate() error {
+	return f.f.Truncate(0)
+}
+
+func (f *osLeaseFile) Close() error {
+	return f.f.Close()
+}
+
+func (f *osLeaseFile) ID() LeaseID {
+	return LeaseID(f.f.Name())
+}
+
+////////////////////////////////////////////////////////////////////////
+// Compressed backend
+////////////////////////////////////////////////////////////////////////
+
+// A LeaseStorage that wraps another one, transparently zstd-compressing
+// lease contents whenever they're not in use. Random-access reads and
+// writes still work: each open lease file is backed by a plain scratch file
+// (allocated from the wrapped storage) for the duration it's open, and is
+// recompressed as a whole into its permanent, compressed form on Close. This
+// costs an extra full pass over the file at close time in exchange for
+// letting cold, rarely-reread cached objects sit on disk compressed instead
+// of raw.
+type CompressedStorage struct {
+	inner LeaseStorage
+}
+
+// Wrap inner so that lease contents are stored compressed.
+func NewCompressedStorage(inner LeaseStorage) *CompressedStorage {
+	return &CompressedStorage{inner: inner}
+}
+
+func (s *CompressedStorage) Create() (LeaseFile, error) {
+	scratch, err := s.inner.Create()
+	if err != nil {
+		return nil, fmt.Errorf("Create scratch: %v", err)
+	}
+
+	blob, err := s.inner.Create()
+	if err != nil {
+		scratch.Close()
+		return nil, fmt.Errorf("Create blob: %v", err)
+	}
+
+	blobID := blob.ID()
+	if err := blob.Close(); err != nil {
+		scratch.Close()
+		return nil, fmt.Errorf("Close blob: %v", err)
+	}
+
+	return &compressedLeaseFile{storage: s, scratch: scratch, blobID: blobID}, nil
+}
+
+func (s *CompressedStorage) Open(id LeaseID) (LeaseFile, error) {
+	blob, err := s.inner.Open(id)
+	if err != nil {
+		return nil, fmt.Errorf("Open blob: %v", err)
+	}
+
+	zr, err := zstd.NewReader(blob)
+	if err != nil {
+		blob.Close()
+		return nil, fmt.Errorf("NewReader: %v", err)
+	}
+
+	scratch, err := s.inner.Create()
+	if err != nil {
+		zr.Close()
+		blob.Close()
+		return nil, fmt.Errorf("Create scratch: %v", err)
+	}
+
+	_, err = io.Copy(scratch, zr)
+	zr.Close()
+	if closeErr := blob.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		scratch.Close()
+		return nil, fmt.Errorf("decompress: %v", err)
+	}
+
+	if _, err = scratch.Seek(0, io.SeekStart); err != nil {
+		scratch.Close()
+		return nil, fmt.Errorf("Seek: %v", err)
+	}
+
+	return &compressedLeaseFile{storage: s, scratch: scratch, blobID: id}, nil
+}
+
+func (s *CompressedStorage) Remove(id LeaseID) error {
+	return s.inner.Remove(id)
+}
+
+// A lease file backed by a plain scratch file while open, compressed into
+// its permanent blob ID on Close.
+type compressedLeaseFile struct {
+	storage *CompressedStorage
+	scratch LeaseFile
+	blobID  LeaseID
+}
+
+func (f *compressedLeaseFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.scratch.ReadAt(p, off)
+}
+
+func (f *compressedLeaseFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.scratch.WriteAt(p, off)
+}
+
+func (f *compressedLeaseFile) Read(p []byte) (int, error) {
+	return f.scratch.Read(p)
+}
+
+func (f *compressedLeaseFile) Write(p []byte) (int, error) {
+	return f.scratch.Write(p)
+}
+
+func (f *compressedLeaseFile) Seek(offset int64, whence int) (int64, error) {
+	return f.scratch.Seek(offset, whence)
+}
+
+func (f *compressedLeaseFile) Truncate() error {
+	return f.scratch.Truncate()
+}
+
+func (f *compressedLeaseFile) ID() LeaseID {
+	return f.blobID
+}
+
+func (f *compressedLeaseFile) Close() (err error) {
+	if _, err = f.scratch.Seek(0, io.SeekStart); err != nil {
+		err = fmt.Errorf("Seek: %v", err)
+		return
+	}
+
+	blob, err := f.storage.inner.Open(f.blobID)
+	if err != nil {
+		err = fmt.Errorf("Open blob: %v", err)
+		return
+	}
+
+	// The blob may already hold a previous compressed version of these
+	// contents (e.g. re-closing after a write). Truncate it first so that a
+	// smaller recompressed stream doesn't leave stale bytes trailing the new
+	// one, which would corrupt the zstd frame on the next Open.
+	if err = blob.Truncate(); err != nil {
+		blob.Close()
+		err = fmt.Errorf("Truncate blob: %v", err)
+		return
+	}
+
+	zw, err := zstd.NewWriter(blob)
+	if err != nil {
+		blob.Close()
+		err = fmt.Errorf("NewWriter: %v", err)
+		return
+	}
+
+	if _, err = io.Copy(zw, f.scratch); err != nil {
+		zw.Close()
+		blob.Close()
+		err = fmt.Errorf("compress: %v", err)
+		return
+	}
+
+	if err = zw.Close(); err != nil {
+		blob.Close()
+		err = fmt.Errorf("zstd Close: %v", err)
+		return
+	}
+
+	if err = blob.Close(); err != nil {
+		err = fmt.Errorf("Close blob: %v", err)
+		return
+	}
+
+	scratchID := f.scratch.ID()
+	if err = f.scratch.Close(); err != nil {
+		err = fmt.Errorf("Close scratch: %v", err)
+		return
+	}
+
+	if err = f.storage.inner.Remove(scratchID); err != nil {
+		err = fmt.Errorf("Remove scratch: %v", err)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,101 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCompressedStorage_RoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lease_storage_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewCompressedStorage(NewTempDirStorage(dir))
+
+	f, err := s.Create()
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	first := bytes.Repeat([]byte("hello world, this is lease content. "), 1000)
+	if _, err := f.Write(first); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	id := f.ID()
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	f, err = s.Open(id)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+
+	if !bytes.Equal(got, first) {
+		t.Fatalf("round-tripped content didn't match: got %d bytes, want %d", len(got), len(first))
+	}
+
+	// Rewrite with shorter content and close again. Before the blob was
+	// truncated ahead of recompression, this left stale bytes from the
+	// longer first version trailing the second, shorter compressed stream.
+	second := []byte("short")
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+
+	if err := f.Truncate(); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+
+	if _, err := f.Write(second); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if got := f.ID(); got != id {
+		t.Fatalf("ID changed across a close/open cycle: got %q, want %q", got, id)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	f, err = s.Open(id)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+
+	got, err = ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+
+	if !bytes.Equal(got, second) {
+		t.Fatalf("got %q, want %q (stale bytes from the longer first write?)", got, second)
+	}
+}